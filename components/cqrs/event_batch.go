@@ -0,0 +1,184 @@
+package cqrs
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// BatchConfig configures how a BatchEventHandler accumulates events before
+// HandleBatch is called.
+type BatchConfig struct {
+	// MaxSize is the maximum number of events accumulated before HandleBatch is
+	// called. Values <= 0 are treated as 1, i.e. no batching.
+	MaxSize int
+
+	// MaxWait is the longest time the first event of a batch waits for MaxSize to
+	// be reached before HandleBatch is called with however many events have
+	// accumulated so far. Zero disables the wait, meaning HandleBatch is only
+	// called once MaxSize is reached.
+	MaxWait time.Duration
+}
+
+// BatchEventHandler is an EventHandler that wants to process several decoded
+// events at once, instead of paying per-message overhead (e.g. a read-model
+// transaction) for each one individually.
+//
+// EventProcessor detects BatchEventHandler via a type assertion in
+// AddHandlersToRouter. Unlike a plain EventHandler, a BatchEventHandler isn't
+// driven through message.Router: the Router only ever has one in-flight
+// HandlerFunc call per subscription, pulling the next message after the
+// current call returns, so a handler that tried to accumulate several
+// messages by blocking inside a HandlerFunc call would never be handed a
+// second one to accumulate - it would just deadlock (or, with a timeout,
+// degrade to batches of size 1). Instead, EventProcessor subscribes the
+// handler directly and drains its channel itself in runBatchHandler,
+// accumulating decoded events up to BatchConfig.MaxSize or until
+// BatchConfig.MaxWait elapses, then calling HandleBatch once per batch.
+//
+// Every message making up a batch is acked or nacked together: if HandleBatch
+// returns an error, every message in the batch is nacked, so redelivery
+// semantics are preserved.
+//
+// Since a batch isn't acked until it reaches BatchConfig.MaxSize or
+// BatchConfig.MaxWait elapses, a BatchEventHandler cannot batch more than one
+// message at a time against a publisher whose Publish call blocks until that
+// message is acked (e.g. gochannel.GoChannel, the bundled Pub/Sub used
+// elsewhere in this repo) if the caller also waits for each Publish call to
+// return before issuing the next - that publish would never be able to reach
+// the rest of the batch. Either publish without waiting on each individual
+// Publish call to return (e.g. one goroutine per message), or use a Publisher
+// that acknowledges asynchronously.
+//
+// Because a BatchEventHandler's subscription isn't owned by message.Router,
+// nothing closes it when the router does. EventProcessor.Close must be called
+// to tear every BatchEventHandler's subscription (and its drainBatches
+// goroutine) down - see runBatchHandler.
+type BatchEventHandler interface {
+	EventHandler
+
+	HandleBatch(ctx context.Context, events []interface{}) error
+
+	BatchConfig() BatchConfig
+}
+
+// runBatchHandler subscribes to topic itself and drains it in a dedicated
+// goroutine, accumulating decoded events into batches of up to
+// BatchConfig.MaxSize (or BatchConfig.MaxWait, whichever comes first) before
+// calling handler.HandleBatch, then acking or nacking every message of the
+// batch based on its result.
+//
+// subscriber is registered with p.batchSubscribers, so EventProcessor.Close
+// can close it - which in turn stops drainBatches, since messages is closed
+// along with it.
+func (p EventProcessor) runBatchHandler(handler BatchEventHandler, subscriber message.Subscriber, topic string, logger watermill.LoggerAdapter) error {
+	initEvent := handler.NewEvent()
+	expectedEventName := p.marshaler.Name(initEvent)
+
+	if err := p.validateEvent(initEvent); err != nil {
+		return err
+	}
+
+	config := handler.BatchConfig()
+	if config.MaxSize <= 0 {
+		config.MaxSize = 1
+	}
+
+	messages, err := subscriber.Subscribe(topic)
+	if err != nil {
+		return errors.Wrap(err, "cannot subscribe for batch event handler")
+	}
+
+	p.batchSubscribers.add(subscriber)
+
+	go p.drainBatches(handler, messages, expectedEventName, config, logger)
+
+	return nil
+}
+
+func (p EventProcessor) drainBatches(
+	handler BatchEventHandler,
+	messages <-chan *message.Message,
+	expectedEventName string,
+	config BatchConfig,
+	logger watermill.LoggerAdapter,
+) {
+	var batch []*message.Message
+	var events []interface{}
+	var timeout <-chan time.Time
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		logger.Debug("Handling event batch", watermill.LogFields{"batch_size": len(batch)})
+
+		err := handler.HandleBatch(batch[0].Context(), events)
+		if err != nil {
+			logger.Debug("Error when handling event batch", watermill.LogFields{"err": err})
+		}
+
+		for _, msg := range batch {
+			if err != nil {
+				msg.Nack()
+			} else {
+				msg.Ack()
+			}
+		}
+
+		batch = nil
+		events = nil
+		timeout = nil
+	}
+
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				flush()
+				return
+			}
+
+			messageEventName := p.marshaler.NameFromMessage(msg)
+			if messageEventName != expectedEventName {
+				logger.Trace("Received different event type than expected, ignoring", watermill.LogFields{
+					"message_uuid":        msg.UUID,
+					"expected_event_type": expectedEventName,
+					"received_event_type": messageEventName,
+				})
+				msg.Ack()
+				continue
+			}
+
+			event := handler.NewEvent()
+			if err := p.marshaler.Unmarshal(msg, event); err != nil {
+				logger.Debug("Error when unmarshaling event for batch", watermill.LogFields{"err": err})
+				msg.Nack()
+				continue
+			}
+
+			logger.Debug("Adding event to batch", watermill.LogFields{
+				"message_uuid":        msg.UUID,
+				"received_event_type": messageEventName,
+			})
+
+			batch = append(batch, msg)
+			events = append(events, event)
+
+			if len(batch) == 1 && config.MaxWait > 0 {
+				timeout = time.After(config.MaxWait)
+			}
+
+			if len(batch) >= config.MaxSize {
+				flush()
+			}
+		case <-timeout:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package cqrs
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/infrastructure/gochannel"
+)
+
+type batchedEvent struct {
+	ID string
+}
+
+type testBatchHandler struct {
+	config BatchConfig
+
+	mu      sync.Mutex
+	batches [][]interface{}
+}
+
+func (h *testBatchHandler) HandlerName() string { return "test_batch_handler" }
+
+func (h *testBatchHandler) NewEvent() interface{} { return &batchedEvent{} }
+
+func (h *testBatchHandler) Handle(ctx context.Context, event interface{}) error { return nil }
+
+func (h *testBatchHandler) HandleBatch(ctx context.Context, events []interface{}) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.batches = append(h.batches, events)
+	return nil
+}
+
+func (h *testBatchHandler) BatchConfig() BatchConfig { return h.config }
+
+func (h *testBatchHandler) snapshot() [][]interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([][]interface{}(nil), h.batches...)
+}
+
+// TestEventProcessor_RunBatchHandler_BatchesMultipleEvents publishes several
+// events and checks that HandleBatch is called with more than one of them at
+// once, instead of the router-driven accumulator deadlocking or silently
+// degrading every batch to size 1.
+//
+// Publishes happen concurrently, one goroutine per message, rather than in a
+// loop on the test goroutine: GoChannel.Publish blocks until every subscriber
+// has acked (see its doc comment), and BatchEventHandler only acks once a
+// batch reaches MaxSize/MaxWait, so a publisher that waited for each Publish
+// call to return before issuing the next could never get a second message to
+// drainBatches and the batch could never exceed size 1. BatchEventHandler
+// therefore requires callers to either publish without waiting on each
+// individual Publish call (as here), or use a Publisher that doesn't block
+// until ack (e.g. a message queue with asynchronous acknowledgement).
+func TestEventProcessor_RunBatchHandler_BatchesMultipleEvents(t *testing.T) {
+	pubSub := gochannel.NewGoChannel(5, watermill.NopLogger{}, -1)
+	defer pubSub.Close()
+
+	handler := &testBatchHandler{config: BatchConfig{MaxSize: 5, MaxWait: time.Second}}
+
+	p := NewEventProcessor(
+		[]EventHandler{handler},
+		func(eventName string) string { return "events" },
+		func(string) (message.Subscriber, error) { return pubSub, nil },
+		jsonMarshaler{},
+		watermill.NopLogger{},
+	)
+
+	if err := p.runBatchHandler(handler, pubSub, "events", watermill.NopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var publishWg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		publishWg.Add(1)
+		go func() {
+			defer publishWg.Done()
+			msg := message.NewMessage(watermill.NewUUID(), nil)
+			if err := pubSub.Publish("events", msg); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	defer publishWg.Wait()
+
+	deadline := time.After(2 * time.Second)
+	for {
+		if batches := handler.snapshot(); len(batches) > 0 {
+			if len(batches[0]) <= 1 {
+				t.Fatalf("expected a batch of multiple events, got %d", len(batches[0]))
+			}
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("timed out waiting for HandleBatch to be called")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// TestEventProcessor_Close_ClosesBatchHandlerSubscriber checks that Close tears
+// down the subscriber passed to runBatchHandler, so neither the underlying
+// subscription nor the drainBatches goroutine it feeds leak once the processor
+// (and, in a full setup, the router built around it) are done.
+func TestEventProcessor_Close_ClosesBatchHandlerSubscriber(t *testing.T) {
+	sub := newFakeSubscriber()
+
+	handler := &testBatchHandler{config: BatchConfig{MaxSize: 5, MaxWait: time.Second}}
+
+	p := NewEventProcessor(
+		[]EventHandler{handler},
+		func(eventName string) string { return "events" },
+		func(string) (message.Subscriber, error) { return sub, nil },
+		jsonMarshaler{},
+		watermill.NopLogger{},
+	)
+
+	if err := p.runBatchHandler(handler, sub, "events", watermill.NopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case _, ok := <-sub.messages:
+		if ok {
+			t.Fatal("expected the batch handler's subscriber to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("EventProcessor.Close did not close the batch handler's subscriber - its subscription and drainBatches goroutine will leak forever")
+	}
+}
@@ -0,0 +1,49 @@
+package cqrs
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// EventBus publishes events, resolving the topic an event should be published to via
+// generateTopic, mirroring CommandBus.
+type EventBus struct {
+	publisher     message.Publisher
+	generateTopic func(eventName string) string
+	marshaler     CommandEventMarshaler
+}
+
+func NewEventBus(
+	publisher message.Publisher,
+	generateTopic func(eventName string) string,
+	marshaler CommandEventMarshaler,
+) *EventBus {
+	if publisher == nil {
+		panic("missing publisher")
+	}
+	if generateTopic == nil {
+		panic("nil generateTopic")
+	}
+	if marshaler == nil {
+		panic("missing marshaler")
+	}
+
+	return &EventBus{publisher, generateTopic, marshaler}
+}
+
+// Publish sends event to the event bus.
+func (b EventBus) Publish(ctx context.Context, event interface{}) error {
+	msg, err := b.marshaler.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal event")
+	}
+
+	msg.SetContext(ctx)
+
+	topicName := b.generateTopic(b.marshaler.Name(event))
+
+	return b.publisher.Publish(topicName, msg)
+}
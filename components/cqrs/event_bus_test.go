@@ -0,0 +1,91 @@
+package cqrs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/infrastructure/gochannel"
+)
+
+type testPublishedEvent struct {
+	ID string
+}
+
+// TestEventBus_Publish_DeliversEventToGeneratedTopic checks that Publish
+// marshals the event and sends it to the topic generateTopic resolves for it,
+// end-to-end against a real Pub/Sub, rather than just asserting on mocked
+// calls to a fake publisher.
+func TestEventBus_Publish_DeliversEventToGeneratedTopic(t *testing.T) {
+	const topic = "events.query" // jsonMarshaler.Name always returns "query"
+
+	pubSub := gochannel.NewGoChannel(1, watermill.NopLogger{}, -1)
+	defer pubSub.Close()
+
+	messages, err := pubSub.Subscribe(topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bus := NewEventBus(
+		pubSub,
+		func(eventName string) string { return "events." + eventName },
+		jsonMarshaler{},
+	)
+
+	event := testPublishedEvent{ID: "123"}
+
+	// GoChannel.Publish blocks until the subscriber acks (see its doc
+	// comment), so it can't be called inline before the select below reads
+	// and acks the message - that would deadlock this goroutine against
+	// itself. It also registers subscribers asynchronously (see
+	// addSubscriber), so a Publish issued right after Subscribe can
+	// occasionally race ahead of registration and be silently dropped;
+	// retrying from the publishing goroutine until a delivery is observed
+	// rules that out without weakening the deadlock fix. Each attempt is
+	// awaited before the next is attempted, so at most one Publish call (and
+	// one buffered message) is ever in flight.
+	publishErrs := make(chan error, 1)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			if err := bus.Publish(context.Background(), event); err != nil {
+				publishErrs <- err
+				return
+			}
+
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}()
+
+	var msg *message.Message
+	select {
+	case msg = <-messages:
+	case err := <-publishErrs:
+		t.Fatal(err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the published event to be delivered")
+	}
+	close(stop)
+	msg.Ack()
+
+	var got testPublishedEvent
+	if err := (jsonMarshaler{}).Unmarshal(msg, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != event {
+		t.Fatalf("expected to receive %+v, got %+v", event, got)
+	}
+}
@@ -0,0 +1,218 @@
+package cqrs
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// RetryConfig configures the Retry EventMiddleware.
+type RetryConfig struct {
+	// MaxRetries is the number of additional attempts made after the first failure.
+	MaxRetries int
+
+	// InitialInterval is the base delay before the first retry. Every actual delay
+	// is randomized to between half of its base value and the full base value (see
+	// jitter) to avoid retry storms.
+	InitialInterval time.Duration
+
+	// MaxInterval caps the delay once it grows past InitialInterval via Multiplier.
+	MaxInterval time.Duration
+
+	// Multiplier grows the delay after every retry. A value <= 1 keeps the delay constant.
+	Multiplier float64
+}
+
+// Retry returns an EventMiddleware that retries a failing handler with exponential
+// backoff and jitter, up to config.MaxRetries times, before giving up and returning
+// the last error.
+func Retry(config RetryConfig) EventMiddleware {
+	return func(next EventHandlerFunc) EventHandlerFunc {
+		return func(ctx context.Context, event interface{}, msg *message.Message) error {
+			interval := config.InitialInterval
+
+			var err error
+			for attempt := 0; attempt <= config.MaxRetries; attempt++ {
+				if err = next(ctx, event, msg); err == nil {
+					return nil
+				}
+
+				if attempt == config.MaxRetries {
+					break
+				}
+
+				select {
+				case <-time.After(jitter(interval)):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+
+				if config.Multiplier > 1 {
+					interval = time.Duration(float64(interval) * config.Multiplier)
+					if config.MaxInterval > 0 && interval > config.MaxInterval {
+						interval = config.MaxInterval
+					}
+				}
+			}
+
+			return err
+		}
+	}
+}
+
+// jitter applies "equal jitter" to interval, returning a duration randomized
+// between interval/2 and interval - the retry delay stays close to interval
+// while still spreading out retries that started at the same time.
+func jitter(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+
+	half := interval / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// SeenStore tracks which message UUIDs have already been handled, backing the
+// Deduplicate middleware. Implementations should be safe for concurrent use.
+type SeenStore interface {
+	// Seen reports whether uuid was already marked as seen, and marks it as seen
+	// for any future call, atomically.
+	Seen(ctx context.Context, uuid string) (bool, error)
+}
+
+// inMemorySeenStore is a SeenStore backed by an unbounded in-memory set. It's
+// useful for tests and single-process deployments; anything that needs to survive
+// a restart or be shared across processes should provide its own SeenStore.
+type inMemorySeenStore struct {
+	seen sync.Map
+}
+
+// NewInMemorySeenStore creates a SeenStore backed by an in-memory set.
+func NewInMemorySeenStore() SeenStore {
+	return &inMemorySeenStore{}
+}
+
+func (s *inMemorySeenStore) Seen(ctx context.Context, uuid string) (bool, error) {
+	_, alreadySeen := s.seen.LoadOrStore(uuid, struct{}{})
+	return alreadySeen, nil
+}
+
+// Deduplicate returns an EventMiddleware that skips handling (acking without
+// calling next) any message whose UUID was already seen according to store.
+func Deduplicate(store SeenStore) EventMiddleware {
+	return func(next EventHandlerFunc) EventHandlerFunc {
+		return func(ctx context.Context, event interface{}, msg *message.Message) error {
+			alreadySeen, err := store.Seen(ctx, msg.UUID)
+			if err != nil {
+				return errors.Wrap(err, "cannot check if message was already seen")
+			}
+			if alreadySeen {
+				return nil
+			}
+
+			return next(ctx, event, msg)
+		}
+	}
+}
+
+// EventMetricsRecorder receives the outcome of every handled event. Implementations
+// typically forward HandlerExecuted to a Prometheus histogram/counter pair labeled
+// by eventName and success.
+type EventMetricsRecorder interface {
+	HandlerExecuted(eventName string, duration time.Duration, err error)
+}
+
+// Metrics returns an EventMiddleware that reports handled/failed counts and
+// handling latency per event name to recorder. The event name is derived from
+// msg via marshaler, the same marshaler passed to NewEventProcessor, so labels
+// match the event names used for topic generation and logging elsewhere in
+// this package, including with a custom CommandEventMarshaler.
+func Metrics(recorder EventMetricsRecorder, marshaler CommandEventMarshaler) EventMiddleware {
+	return func(next EventHandlerFunc) EventHandlerFunc {
+		return func(ctx context.Context, event interface{}, msg *message.Message) error {
+			start := time.Now()
+			err := next(ctx, event, msg)
+			recorder.HandlerExecuted(marshaler.NameFromMessage(msg), time.Since(start), err)
+			return err
+		}
+	}
+}
+
+// RecoverPanic returns an EventMiddleware that recovers from a panic in the rest of
+// the middleware chain (or the handler itself), converting it into an error so the
+// message is nacked instead of crashing the router's goroutine.
+func RecoverPanic(logger watermill.LoggerAdapter) EventMiddleware {
+	if logger == nil {
+		logger = watermill.NopLogger{}
+	}
+
+	return func(next EventHandlerFunc) EventHandlerFunc {
+		return func(ctx context.Context, event interface{}, msg *message.Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Error("Panic recovered in event handler", errors.Errorf("%v", r), watermill.LogFields{
+						"message_uuid": msg.UUID,
+					})
+					err = errors.Errorf("panic recovered in event handler: %v", r)
+				}
+			}()
+
+			return next(ctx, event, msg)
+		}
+	}
+}
+
+// PoisonQueueConfig configures the PoisonQueue middleware.
+type PoisonQueueConfig struct {
+	// Publisher is used to republish a message to Topic once it has failed
+	// MaxRetries times.
+	Publisher message.Publisher
+
+	// Topic is the dead-letter topic messages are forwarded to.
+	Topic string
+
+	// MaxRetries is how many times a message is allowed to fail before being
+	// forwarded to Topic instead of returning the error to the router.
+	MaxRetries int
+}
+
+// PoisonQueue returns an EventMiddleware that, after a message has failed
+// config.MaxRetries times, republishes it unchanged to config.Topic and acks it,
+// instead of letting it fail (and potentially be redelivered) forever. It should
+// be placed outside of Retry in the middleware chain, so it sees failures that
+// already exhausted their retries.
+func PoisonQueue(config PoisonQueueConfig) EventMiddleware {
+	failureCounts := sync.Map{}
+
+	return func(next EventHandlerFunc) EventHandlerFunc {
+		return func(ctx context.Context, event interface{}, msg *message.Message) error {
+			err := next(ctx, event, msg)
+			if err == nil {
+				failureCounts.Delete(msg.UUID)
+				return nil
+			}
+
+			counter, _ := failureCounts.LoadOrStore(msg.UUID, new(int32))
+			failures := atomic.AddInt32(counter.(*int32), 1)
+
+			if int(failures) < config.MaxRetries {
+				return err
+			}
+
+			failureCounts.Delete(msg.UUID)
+
+			if pubErr := config.Publisher.Publish(config.Topic, msg); pubErr != nil {
+				return errors.Wrap(pubErr, "cannot forward message to poison queue")
+			}
+
+			return nil
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package cqrs
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// TestRetry_RetriesUntilSuccessThenStops checks that Retry calls next again
+// after a failure, up to config.MaxRetries times, and stops retrying as soon
+// as next succeeds.
+func TestRetry_RetriesUntilSuccessThenStops(t *testing.T) {
+	var attempts int32
+
+	next := EventHandlerFunc(func(ctx context.Context, event interface{}, msg *message.Message) error {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			return errors.New("not yet")
+		}
+		return nil
+	})
+
+	handle := Retry(RetryConfig{MaxRetries: 5, InitialInterval: time.Millisecond})(next)
+
+	msg := message.NewMessage(watermill.NewUUID(), nil)
+	if err := handle(context.Background(), nil, msg); err != nil {
+		t.Fatalf("expected eventual success, got %v", err)
+	}
+
+	if got := atomic.LoadInt32(&attempts); got != 3 {
+		t.Fatalf("expected exactly 3 attempts (2 failures + 1 success), got %d", got)
+	}
+}
+
+// TestRetry_GivesUpAfterMaxRetries checks that Retry stops after
+// config.MaxRetries additional attempts and returns the last error, instead of
+// retrying forever.
+func TestRetry_GivesUpAfterMaxRetries(t *testing.T) {
+	var attempts int32
+	wantErr := errors.New("always fails")
+
+	next := EventHandlerFunc(func(ctx context.Context, event interface{}, msg *message.Message) error {
+		atomic.AddInt32(&attempts, 1)
+		return wantErr
+	})
+
+	handle := Retry(RetryConfig{MaxRetries: 2, InitialInterval: time.Millisecond})(next)
+
+	msg := message.NewMessage(watermill.NewUUID(), nil)
+	err := handle(context.Background(), nil, msg)
+	if errors.Cause(err) != wantErr {
+		t.Fatalf("expected the last error to be returned, got %v", err)
+	}
+
+	if got := atomic.LoadInt32(&attempts); got != 3 {
+		t.Fatalf("expected 1 initial attempt + 2 retries = 3 calls, got %d", got)
+	}
+}
+
+// TestJitter_StaysWithinHalfToOneOfInterval checks that jitter never produces
+// a delay shorter than interval/2 or longer than interval, the bounds Retry
+// relies on to avoid both retry storms and unbounded waits.
+func TestJitter_StaysWithinHalfToOneOfInterval(t *testing.T) {
+	const interval = 100 * time.Millisecond
+
+	for i := 0; i < 100; i++ {
+		got := jitter(interval)
+		if got < interval/2 || got > interval {
+			t.Fatalf("jitter(%s) = %s, want within [%s, %s]", interval, got, interval/2, interval)
+		}
+	}
+}
+
+// TestDeduplicate_SkipsMessageAlreadySeen checks that Deduplicate calls next
+// for a message UUID once, and skips (acking without calling next again) every
+// later message sharing that UUID.
+func TestDeduplicate_SkipsMessageAlreadySeen(t *testing.T) {
+	var calls int32
+
+	next := EventHandlerFunc(func(ctx context.Context, event interface{}, msg *message.Message) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})
+
+	handle := Deduplicate(NewInMemorySeenStore())(next)
+
+	msg := message.NewMessage(watermill.NewUUID(), nil)
+
+	if err := handle(context.Background(), nil, msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := handle(context.Background(), nil, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("expected next to be called once for a duplicate message, got %d", got)
+	}
+}
+
+// recordingMetricsRecorder collects the arguments HandlerExecuted was called
+// with, so tests can assert on them.
+type recordingMetricsRecorder struct {
+	mu        sync.Mutex
+	eventName string
+	err       error
+}
+
+func (r *recordingMetricsRecorder) HandlerExecuted(eventName string, duration time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.eventName = eventName
+	r.err = err
+}
+
+// TestMetrics_UsesMarshalerEventNameNotGoType checks that Metrics labels events
+// via marshaler.NameFromMessage, the "event name" concept used for topic
+// generation and logging elsewhere in this package, rather than the event's Go
+// type - a custom marshaler with a different naming convention would otherwise
+// produce metrics that don't match topic/log names.
+func TestMetrics_UsesMarshalerEventNameNotGoType(t *testing.T) {
+	recorder := &recordingMetricsRecorder{}
+
+	next := EventHandlerFunc(func(ctx context.Context, event interface{}, msg *message.Message) error {
+		return nil
+	})
+
+	handle := Metrics(recorder, jsonMarshaler{})(next)
+
+	type someGoEvent struct{}
+
+	msg := message.NewMessage(watermill.NewUUID(), nil)
+	if err := handle(context.Background(), &someGoEvent{}, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+
+	// jsonMarshaler.NameFromMessage always returns "query", regardless of the
+	// event's Go type - proving Metrics went through the marshaler rather than
+	// fmt.Sprintf("%T", event), which would have recorded "*cqrs.someGoEvent".
+	if recorder.eventName != "query" {
+		t.Fatalf("expected Metrics to use marshaler.NameFromMessage, got event name %q", recorder.eventName)
+	}
+}
+
+// TestRecoverPanic_ConvertsPanicToError checks that RecoverPanic turns a panic
+// in the rest of the chain into an error, so the message is nacked instead of
+// crashing the router's goroutine.
+func TestRecoverPanic_ConvertsPanicToError(t *testing.T) {
+	next := EventHandlerFunc(func(ctx context.Context, event interface{}, msg *message.Message) error {
+		panic("boom")
+	})
+
+	handle := RecoverPanic(watermill.NopLogger{})(next)
+
+	msg := message.NewMessage(watermill.NewUUID(), nil)
+	err := handle(context.Background(), nil, msg)
+	if err == nil {
+		t.Fatal("expected the panic to be converted into an error")
+	}
+}
+
+// capturingPublisher records every message published to it, so
+// TestPoisonQueue_ForwardsAfterMaxRetries can assert on what was forwarded to
+// the dead-letter topic.
+type capturingPublisher struct {
+	mu        sync.Mutex
+	published map[string][]*message.Message
+}
+
+func newCapturingPublisher() *capturingPublisher {
+	return &capturingPublisher{published: make(map[string][]*message.Message)}
+}
+
+func (p *capturingPublisher) Publish(topic string, messages ...*message.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.published[topic] = append(p.published[topic], messages...)
+	return nil
+}
+
+func (p *capturingPublisher) count(topic string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.published[topic])
+}
+
+// TestPoisonQueue_ForwardsAfterMaxRetries checks that PoisonQueue lets a
+// failure through unchanged until it has happened config.MaxRetries times for
+// the same message, then forwards that message to the dead-letter topic and
+// swallows the error instead of failing forever.
+func TestPoisonQueue_ForwardsAfterMaxRetries(t *testing.T) {
+	publisher := newCapturingPublisher()
+	wantErr := errors.New("always fails")
+
+	next := EventHandlerFunc(func(ctx context.Context, event interface{}, msg *message.Message) error {
+		return wantErr
+	})
+
+	handle := PoisonQueue(PoisonQueueConfig{
+		Publisher:  publisher,
+		Topic:      "dead_letter",
+		MaxRetries: 3,
+	})(next)
+
+	msg := message.NewMessage(watermill.NewUUID(), nil)
+
+	for i := 0; i < 2; i++ {
+		if err := handle(context.Background(), nil, msg); errors.Cause(err) != wantErr {
+			t.Fatalf("expected the original error before MaxRetries is reached, got %v", err)
+		}
+	}
+	if publisher.count("dead_letter") != 0 {
+		t.Fatal("expected nothing forwarded to the dead-letter topic before MaxRetries is reached")
+	}
+
+	if err := handle(context.Background(), nil, msg); err != nil {
+		t.Fatalf("expected the error to be swallowed once the message is forwarded to the dead-letter topic, got %v", err)
+	}
+	if publisher.count("dead_letter") != 1 {
+		t.Fatalf("expected the message to be forwarded to the dead-letter topic exactly once, got %d", publisher.count("dead_letter"))
+	}
+}
@@ -2,6 +2,7 @@ package cqrs
 
 import (
 	"context"
+	"sync"
 
 	"github.com/pkg/errors"
 
@@ -33,6 +34,17 @@ type EventHandler interface {
 // It allows you to create separated customized Subscriber for every command handler.
 type EventsSubscriberConstructor func(handlerName string) (message.Subscriber, error)
 
+// EventHandlerFunc is run for every received event, after it was unmarshaled into
+// its concrete type. Unlike message.HandlerFunc, it gives EventMiddleware access to
+// both the decoded event and the underlying message.
+type EventHandlerFunc func(ctx context.Context, event interface{}, msg *message.Message) error
+
+// EventMiddleware wraps an EventHandlerFunc with additional behaviour, such as
+// retries, deduplication, metrics or panic recovery. It mirrors message.Router's
+// HandlerMiddleware, but operates on the already-decoded event, so users don't have
+// to reach into the router middleware layer and lose access to the event type.
+type EventMiddleware func(EventHandlerFunc) EventHandlerFunc
+
 // EventProcessor determines which EventHandler should handle event received from event bus.
 type EventProcessor struct {
 	handlers      []EventHandler
@@ -40,8 +52,27 @@ type EventProcessor struct {
 
 	subscriberConstructor EventsSubscriberConstructor
 
-	marshaler CommandEventMarshaler
-	logger    watermill.LoggerAdapter
+	marshaler   CommandEventMarshaler
+	logger      watermill.LoggerAdapter
+	middlewares []EventMiddleware
+
+	// batchSubscribers tracks the subscriber created for every
+	// BatchEventHandler's independent subscription (see runBatchHandler), so
+	// Close can tear all of them down in one call. It's a pointer so every
+	// copy of EventProcessor - its methods take a value receiver - shares the
+	// same tracker.
+	batchSubscribers *batchSubscriberTracker
+}
+
+// EventProcessorOption configures an EventProcessor created by NewEventProcessor.
+type EventProcessorOption func(*EventProcessor)
+
+// WithMiddlewares adds EventMiddleware to the EventProcessor. Middlewares are
+// applied in the order they are passed, the first one being the outermost.
+func WithMiddlewares(middlewares ...EventMiddleware) EventProcessorOption {
+	return func(p *EventProcessor) {
+		p.middlewares = append(p.middlewares, middlewares...)
+	}
 }
 
 func NewEventProcessor(
@@ -50,6 +81,7 @@ func NewEventProcessor(
 	subscriberConstructor EventsSubscriberConstructor,
 	marshaler CommandEventMarshaler,
 	logger watermill.LoggerAdapter,
+	options ...EventProcessorOption,
 ) *EventProcessor {
 	if len(handlers) == 0 {
 		panic("missing handlers")
@@ -67,13 +99,69 @@ func NewEventProcessor(
 		logger = watermill.NopLogger{}
 	}
 
-	return &EventProcessor{
-		handlers,
-		generateTopic,
-		subscriberConstructor,
-		marshaler,
-		logger,
+	p := &EventProcessor{
+		handlers:              handlers,
+		generateTopic:         generateTopic,
+		subscriberConstructor: subscriberConstructor,
+		marshaler:             marshaler,
+		logger:                logger,
+		batchSubscribers:      &batchSubscriberTracker{},
+	}
+
+	for _, option := range options {
+		option(p)
+	}
+
+	return p
+}
+
+// Close closes every BatchEventHandler's independent subscriber in one call.
+// Regular EventHandlers don't need this: they're registered with
+// message.Router via AddNoPublisherHandler, so Router.Close already closes
+// their subscriber. Batch handlers bypass the router entirely (see
+// BatchEventHandler's doc comment for why), so nothing else tears them down.
+func (p EventProcessor) Close() error {
+	return p.batchSubscribers.CloseAll()
+}
+
+// batchSubscriberTracker collects the subscribers created for
+// BatchEventHandlers as they're registered, so EventProcessor.Close can close
+// all of them together without the caller having to track one per handler.
+type batchSubscriberTracker struct {
+	mu          sync.Mutex
+	subscribers []message.Subscriber
+	closed      bool
+}
+
+// add registers subscriber to be closed by CloseAll. If CloseAll was already
+// called, subscriber is closed immediately instead.
+func (t *batchSubscriberTracker) add(subscriber message.Subscriber) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		subscriber.Close()
+		return
+	}
+
+	t.subscribers = append(t.subscribers, subscriber)
+}
+
+func (t *batchSubscriberTracker) CloseAll() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+
+	for _, subscriber := range t.subscribers {
+		subscriber.Close()
 	}
+	t.subscribers = nil
+
+	return nil
 }
 
 func (p EventProcessor) AddHandlersToRouter(r *message.Router) error {
@@ -88,18 +176,32 @@ func (p EventProcessor) AddHandlersToRouter(r *message.Router) error {
 			"topic":              topicName,
 		})
 
-		handlerFunc, err := p.RouterHandlerFunc(handler, logger)
+		subscriber, err := p.subscriberConstructor(handlerName)
 		if err != nil {
-			return err
+			return errors.Wrap(err, "cannot create subscriber for event processor")
 		}
 
-		logger.Debug("Adding CQRS event handler to router", nil)
+		// BatchEventHandler is never added to the router: message.Router only ever has
+		// one HandlerFunc call in flight per subscription, pulling the next message
+		// after that call returns, so it can never hand a handler the concurrent
+		// messages a batch needs to accumulate. Instead it subscribes and drains
+		// itself, see runBatchHandler.
+		if batchHandler, ok := handler.(BatchEventHandler); ok {
+			logger.Debug("Adding CQRS batch event handler", nil)
 
-		subscriber, err := p.subscriberConstructor(handlerName)
+			if err := p.runBatchHandler(batchHandler, subscriber, topicName, logger); err != nil {
+				return err
+			}
+			continue
+		}
+
+		handlerFunc, err := p.RouterHandlerFunc(handler, logger)
 		if err != nil {
-			return errors.Wrap(err, "cannot create subscriber for event processor")
+			return err
 		}
 
+		logger.Debug("Adding CQRS event handler to router", nil)
+
 		r.AddNoPublisherHandler(
 			handlerName,
 			topicName,
@@ -123,6 +225,8 @@ func (p EventProcessor) RouterHandlerFunc(handler EventHandler, logger watermill
 		return nil, err
 	}
 
+	handle := p.decorateHandler(handler)
+
 	return func(msg *message.Message) ([]*message.Message, error) {
 		event := handler.NewEvent()
 		messageEventName := p.marshaler.NameFromMessage(msg)
@@ -145,7 +249,7 @@ func (p EventProcessor) RouterHandlerFunc(handler EventHandler, logger watermill
 			return nil, err
 		}
 
-		if err := handler.Handle(msg.Context(), event); err != nil {
+		if err := handle(msg.Context(), event, msg); err != nil {
 			logger.Debug("Error when handling event", watermill.LogFields{"err": err})
 			return nil, err
 		}
@@ -154,6 +258,20 @@ func (p EventProcessor) RouterHandlerFunc(handler EventHandler, logger watermill
 	}, nil
 }
 
+// decorateHandler wraps handler.Handle with every registered EventMiddleware, the
+// first middleware passed to WithMiddlewares ending up as the outermost call.
+func (p EventProcessor) decorateHandler(handler EventHandler) EventHandlerFunc {
+	handle := EventHandlerFunc(func(ctx context.Context, event interface{}, msg *message.Message) error {
+		return handler.Handle(ctx, event)
+	})
+
+	for i := len(p.middlewares) - 1; i >= 0; i-- {
+		handle = p.middlewares[i](handle)
+	}
+
+	return handle
+}
+
 func (p EventProcessor) validateEvent(event interface{}) error {
 	// EventHandler's NewEvent must return a pointer, because it is used to unmarshal
 	if err := isPointer(event); err != nil {
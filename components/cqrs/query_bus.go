@@ -0,0 +1,164 @@
+package cqrs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// Metadata keys used to correlate a query with its reply, set by QueryBus and read
+// back by QueryProcessor/QueryBus.
+const (
+	QueryCorrelationIDMetadataKey = "_query_correlation_id"
+	QueryReplyTopicMetadataKey    = "_query_reply_topic"
+	QueryErrorMetadataKey         = "_query_error"
+)
+
+// QueryBus implements synchronous request/response over any watermill Pub/Sub.
+// Send publishes query to the topic resolved by generateTopic, tagging it with a
+// per-call correlation ID and a reply topic unique to this QueryBus instance, then
+// blocks until the matching reply arrives, the context is done, or the bus is closed.
+type QueryBus struct {
+	publisher         message.Publisher
+	repliesSubscriber message.Subscriber
+	generateTopic     func(queryName string) string
+	replyTopic        string
+	marshaler         CommandEventMarshaler
+	logger            watermill.LoggerAdapter
+
+	repliesLock sync.Mutex
+	replies     map[string]chan *message.Message
+
+	closeOnce sync.Once
+	closing   chan struct{}
+}
+
+// NewQueryBus creates a QueryBus. repliesSubscriber is used once, to subscribe to
+// this bus instance's reply topic - it should not be shared with unrelated
+// subscriptions.
+func NewQueryBus(
+	publisher message.Publisher,
+	repliesSubscriber message.Subscriber,
+	generateTopic func(queryName string) string,
+	marshaler CommandEventMarshaler,
+	logger watermill.LoggerAdapter,
+) (*QueryBus, error) {
+	if publisher == nil {
+		panic("missing publisher")
+	}
+	if repliesSubscriber == nil {
+		panic("missing repliesSubscriber")
+	}
+	if generateTopic == nil {
+		panic("nil generateTopic")
+	}
+	if marshaler == nil {
+		panic("missing marshaler")
+	}
+	if logger == nil {
+		logger = watermill.NopLogger{}
+	}
+
+	replyTopic := fmt.Sprintf("cqrs_query_reply_%s", uuid.NewV4().String())
+
+	replies, err := repliesSubscriber.Subscribe(replyTopic)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot subscribe to query reply topic")
+	}
+
+	b := &QueryBus{
+		publisher:         publisher,
+		repliesSubscriber: repliesSubscriber,
+		generateTopic:     generateTopic,
+		replyTopic:        replyTopic,
+		marshaler:         marshaler,
+		logger:            logger,
+
+		replies: make(map[string]chan *message.Message),
+		closing: make(chan struct{}),
+	}
+
+	go b.handleReplies(replies)
+
+	return b, nil
+}
+
+// Send publishes query and blocks until the corresponding reply is unmarshaled into
+// result, ctx is done, or the QueryBus is closed.
+func (b *QueryBus) Send(ctx context.Context, query interface{}, result interface{}) error {
+	msg, err := b.marshaler.Marshal(query)
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal query")
+	}
+
+	correlationID := uuid.NewV4().String()
+	msg.Metadata.Set(QueryCorrelationIDMetadataKey, correlationID)
+	msg.Metadata.Set(QueryReplyTopicMetadataKey, b.replyTopic)
+	msg.SetContext(ctx)
+
+	replyChan := make(chan *message.Message, 1)
+	b.repliesLock.Lock()
+	b.replies[correlationID] = replyChan
+	b.repliesLock.Unlock()
+	defer func() {
+		b.repliesLock.Lock()
+		delete(b.replies, correlationID)
+		b.repliesLock.Unlock()
+	}()
+
+	topicName := b.generateTopic(b.marshaler.Name(query))
+	if err := b.publisher.Publish(topicName, msg); err != nil {
+		return errors.Wrap(err, "cannot publish query")
+	}
+
+	select {
+	case reply := <-replyChan:
+		if queryErr := reply.Metadata.Get(QueryErrorMetadataKey); queryErr != "" {
+			return errors.New(queryErr)
+		}
+		return b.marshaler.Unmarshal(reply, result)
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-b.closing:
+		return errors.New("query bus is closed")
+	}
+}
+
+func (b *QueryBus) handleReplies(messages <-chan *message.Message) {
+	for msg := range messages {
+		correlationID := msg.Metadata.Get(QueryCorrelationIDMetadataKey)
+
+		b.repliesLock.Lock()
+		replyChan, ok := b.replies[correlationID]
+		b.repliesLock.Unlock()
+
+		if ok {
+			replyChan <- msg
+		} else {
+			b.logger.Debug("Received query reply for unknown or already-completed query", watermill.LogFields{
+				"correlation_id": correlationID,
+			})
+		}
+
+		msg.Ack()
+	}
+}
+
+// Close stops waiting for any in-flight reply, causing every pending Send call to
+// return an error, and closes the reply subscriber, stopping the goroutine started
+// by NewQueryBus to handle incoming replies.
+func (b *QueryBus) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		close(b.closing)
+		err = b.repliesSubscriber.Close()
+	})
+	return err
+}
@@ -0,0 +1,193 @@
+package cqrs
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/infrastructure/gochannel"
+)
+
+// fakeSubscriber is a minimal message.Subscriber that only tracks whether Close
+// was called, so this test doesn't need a full Pub/Sub implementation to check
+// QueryBus.Close's cleanup behaviour.
+type fakeSubscriber struct {
+	messages chan *message.Message
+	closed   bool
+}
+
+func newFakeSubscriber() *fakeSubscriber {
+	return &fakeSubscriber{messages: make(chan *message.Message)}
+}
+
+func (s *fakeSubscriber) Subscribe(topic string) (chan *message.Message, error) {
+	return s.messages, nil
+}
+
+func (s *fakeSubscriber) Close() error {
+	if !s.closed {
+		s.closed = true
+		close(s.messages)
+	}
+	return nil
+}
+
+type noopPublisher struct{}
+
+func (noopPublisher) Publish(topic string, messages ...*message.Message) error {
+	return nil
+}
+
+// jsonMarshaler is a minimal CommandEventMarshaler, good enough to construct a
+// QueryBus in tests without depending on a real marshaler implementation.
+type jsonMarshaler struct{}
+
+func (jsonMarshaler) Marshal(v interface{}) (*message.Message, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot marshal")
+	}
+	return message.NewMessage(watermill.NewUUID(), payload), nil
+}
+
+func (jsonMarshaler) Unmarshal(msg *message.Message, v interface{}) error {
+	return json.Unmarshal(msg.Payload, v)
+}
+
+func (jsonMarshaler) Name(v interface{}) string {
+	return "query"
+}
+
+func (jsonMarshaler) NameFromMessage(msg *message.Message) string {
+	return "query"
+}
+
+// TestQueryBus_Close_ClosesRepliesSubscriber checks that Close tears down the
+// reply subscriber passed to NewQueryBus, so the goroutine started by NewQueryBus
+// to drain it actually stops instead of leaking for the life of the process.
+func TestQueryBus_Close_ClosesRepliesSubscriber(t *testing.T) {
+	repliesSubscriber := newFakeSubscriber()
+
+	bus, err := NewQueryBus(noopPublisher{}, repliesSubscriber, func(string) string { return "queries" }, jsonMarshaler{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !repliesSubscriber.closed {
+		t.Fatal("QueryBus.Close did not close the repliesSubscriber - its handleReplies goroutine will leak forever")
+	}
+}
+
+type greetQuery struct {
+	Name string
+}
+
+type greetResult struct {
+	Greeting string
+}
+
+type greetQueryHandler struct{}
+
+func (greetQueryHandler) HandlerName() string { return "greet_query_handler" }
+
+func (greetQueryHandler) NewQuery() interface{} { return &greetQuery{} }
+
+func (greetQueryHandler) Handle(ctx context.Context, query interface{}) (interface{}, error) {
+	q := query.(*greetQuery)
+	if q.Name == "" {
+		return nil, errors.New("name is required")
+	}
+	return greetResult{Greeting: "hello, " + q.Name}, nil
+}
+
+// TestQueryBus_Send_RoundTripsThroughQueryProcessor exercises the full CQRS
+// query path end-to-end against a real Pub/Sub: QueryBus.Send publishes a
+// query, message.Router dispatches it to QueryProcessor's handler via a
+// correlation-id-tagged reply topic, and Send unmarshals the result QueryBus
+// receives back - the scenario every other test in this file only covers a
+// slice of.
+func TestQueryBus_Send_RoundTripsThroughQueryProcessor(t *testing.T) {
+	pubSub := gochannel.NewGoChannel(0, watermill.NopLogger{}, -1)
+	defer pubSub.Close()
+
+	generateTopic := func(queryName string) string { return "queries." + queryName }
+
+	processor := NewQueryProcessor(
+		[]QueryHandler{greetQueryHandler{}},
+		generateTopic,
+		func(string) (message.Subscriber, error) { return pubSub, nil },
+		pubSub,
+		jsonMarshaler{},
+		watermill.NopLogger{},
+	)
+
+	router, err := message.NewRouter(message.RouterConfig{}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := processor.AddHandlersToRouter(router); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runDone := make(chan error, 1)
+	go func() {
+		runDone <- router.Run(ctx)
+	}()
+	<-router.Running()
+
+	defer func() {
+		cancel()
+		<-runDone
+	}()
+
+	bus, err := NewQueryBus(pubSub, pubSub.Subscriber(), generateTopic, jsonMarshaler{}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Close()
+
+	// GoChannel registers subscribers asynchronously (see addSubscriber), so
+	// neither router.Running() above (confirms the router's loop started, not
+	// that the query handler's subscription is registered) nor NewQueryBus
+	// returning (same, for the reply-topic subscription) guarantee a query or
+	// its reply won't race ahead of registration and be silently dropped.
+	// sendQuery retries on a deadline-exceeded Send, which for this handler is
+	// otherwise side-effect-free, until one attempt gets all the way through.
+	sendQuery := func(query interface{}, out interface{}) error {
+		var err error
+		for attempt := 0; attempt < 20; attempt++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			err = bus.Send(ctx, query, out)
+			cancel()
+			if err != context.DeadlineExceeded {
+				return err
+			}
+		}
+		return err
+	}
+
+	var result greetResult
+	if err := sendQuery(greetQuery{Name: "watermill"}, &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Greeting != "hello, watermill" {
+		t.Fatalf("expected a greeting built from the query, got %+v", result)
+	}
+
+	var failed greetResult
+	if err := sendQuery(greetQuery{}, &failed); err == nil {
+		t.Fatal("expected an error for an invalid query")
+	}
+}
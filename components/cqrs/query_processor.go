@@ -0,0 +1,199 @@
+package cqrs
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// QueryHandler handles a single query type and returns its result, which
+// QueryProcessor marshals back to the caller's reply topic.
+//
+// In contrast to EventHandler, every query has exactly one QueryHandler.
+type QueryHandler interface {
+	// HandlerName is named used in message.Router for creating handler.
+	HandlerName() string
+
+	NewQuery() interface{}
+
+	Handle(ctx context.Context, query interface{}) (interface{}, error)
+}
+
+// QueriesSubscriberConstructor creates subscriber for QueryHandler.
+// It allows you to create separated customized Subscriber for every query handler.
+type QueriesSubscriberConstructor func(handlerName string) (message.Subscriber, error)
+
+// QueryProcessor determines which QueryHandler should handle a query received from
+// the query bus, and publishes its result back to the reply topic carried in the
+// query's metadata.
+type QueryProcessor struct {
+	handlers      []QueryHandler
+	generateTopic func(queryName string) string
+
+	subscriberConstructor QueriesSubscriberConstructor
+	replyPublisher        message.Publisher
+
+	marshaler CommandEventMarshaler
+	logger    watermill.LoggerAdapter
+}
+
+func NewQueryProcessor(
+	handlers []QueryHandler,
+	generateTopic func(queryName string) string,
+	subscriberConstructor QueriesSubscriberConstructor,
+	replyPublisher message.Publisher,
+	marshaler CommandEventMarshaler,
+	logger watermill.LoggerAdapter,
+) *QueryProcessor {
+	if len(handlers) == 0 {
+		panic("missing handlers")
+	}
+	if generateTopic == nil {
+		panic("nil generateTopic")
+	}
+	if subscriberConstructor == nil {
+		panic("missing subscriberConstructor")
+	}
+	if replyPublisher == nil {
+		panic("missing replyPublisher")
+	}
+	if marshaler == nil {
+		panic("missing marshaler")
+	}
+	if logger == nil {
+		logger = watermill.NopLogger{}
+	}
+
+	return &QueryProcessor{
+		handlers,
+		generateTopic,
+		subscriberConstructor,
+		replyPublisher,
+		marshaler,
+		logger,
+	}
+}
+
+func (p QueryProcessor) AddHandlersToRouter(r *message.Router) error {
+	for i := range p.Handlers() {
+		handler := p.handlers[i]
+		handlerName := handler.HandlerName()
+		queryName := p.marshaler.Name(handler.NewQuery())
+		topicName := p.generateTopic(queryName)
+
+		logger := p.logger.With(watermill.LogFields{
+			"query_handler_name": handlerName,
+			"topic":              topicName,
+		})
+
+		handlerFunc, err := p.RouterHandlerFunc(handler, logger)
+		if err != nil {
+			return err
+		}
+
+		logger.Debug("Adding CQRS query handler to router", nil)
+
+		subscriber, err := p.subscriberConstructor(handlerName)
+		if err != nil {
+			return errors.Wrap(err, "cannot create subscriber for query processor")
+		}
+
+		r.AddNoPublisherHandler(
+			handlerName,
+			topicName,
+			subscriber,
+			handlerFunc,
+		)
+	}
+
+	return nil
+}
+
+func (p QueryProcessor) Handlers() []QueryHandler {
+	return p.handlers
+}
+
+func (p QueryProcessor) RouterHandlerFunc(handler QueryHandler, logger watermill.LoggerAdapter) (message.HandlerFunc, error) {
+	initQuery := handler.NewQuery()
+	expectedQueryName := p.marshaler.Name(initQuery)
+
+	if err := p.validateQuery(initQuery); err != nil {
+		return nil, err
+	}
+
+	return func(msg *message.Message) ([]*message.Message, error) {
+		query := handler.NewQuery()
+		messageQueryName := p.marshaler.NameFromMessage(msg)
+
+		if messageQueryName != expectedQueryName {
+			logger.Trace("Received different query type than expected, ignoring", watermill.LogFields{
+				"message_uuid":        msg.UUID,
+				"expected_query_type": expectedQueryName,
+				"received_query_type": messageQueryName,
+			})
+			return nil, nil
+		}
+
+		logger.Debug("Handling query", watermill.LogFields{
+			"message_uuid":        msg.UUID,
+			"received_query_type": messageQueryName,
+		})
+
+		if err := p.marshaler.Unmarshal(msg, query); err != nil {
+			return nil, err
+		}
+
+		replyTopic := msg.Metadata.Get(QueryReplyTopicMetadataKey)
+		correlationID := msg.Metadata.Get(QueryCorrelationIDMetadataKey)
+
+		result, handleErr := handler.Handle(msg.Context(), query)
+		if handleErr != nil {
+			logger.Debug("Error when handling query", watermill.LogFields{"err": handleErr})
+		}
+
+		if replyTopic == "" {
+			// no caller is waiting for a reply, nothing more to do
+			return nil, handleErr
+		}
+
+		reply, err := p.buildReply(result, handleErr, correlationID)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.replyPublisher.Publish(replyTopic, reply); err != nil {
+			return nil, errors.Wrap(err, "cannot publish query reply")
+		}
+
+		return nil, nil
+	}, nil
+}
+
+func (p QueryProcessor) buildReply(result interface{}, handleErr error, correlationID string) (*message.Message, error) {
+	if handleErr != nil {
+		reply := message.NewMessage(watermill.NewUUID(), nil)
+		reply.Metadata.Set(QueryCorrelationIDMetadataKey, correlationID)
+		reply.Metadata.Set(QueryErrorMetadataKey, handleErr.Error())
+		return reply, nil
+	}
+
+	reply, err := p.marshaler.Marshal(result)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot marshal query result")
+	}
+	reply.Metadata.Set(QueryCorrelationIDMetadataKey, correlationID)
+
+	return reply, nil
+}
+
+func (p QueryProcessor) validateQuery(query interface{}) error {
+	// QueryHandler's NewQuery must return a pointer, because it is used to unmarshal
+	if err := isPointer(query); err != nil {
+		return errors.Wrap(err, "query must be a non-nil pointer")
+	}
+
+	return nil
+}
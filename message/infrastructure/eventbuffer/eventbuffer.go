@@ -0,0 +1,394 @@
+// Package eventbuffer provides an in-process Pub/Sub that keeps a bounded,
+// time-limited history of recently published events per topic, so that
+// subscribers which reconnect can resume from a specific point instead of
+// only ever seeing messages published after they subscribed.
+package eventbuffer
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// ErrSnapshotRequired is returned by SubscribeFromOffset when the requested
+// sequence number has already been evicted from the buffer. Callers should
+// register a SnapshotHandler for the topic via RegisterSnapshotHandler and
+// retry, so EventBuffer can seed the subscriber with a base snapshot before
+// streaming live events on top of it.
+type ErrSnapshotRequired struct {
+	Topic  string
+	Offset uint64
+}
+
+func (e ErrSnapshotRequired) Error() string {
+	return fmt.Sprintf("offset %d for topic %q was evicted from the buffer, a snapshot is required", e.Offset, e.Topic)
+}
+
+// SnapshotHandler produces a base snapshot of events for topic, along with the
+// sequence number that snapshot represents. Events with a higher sequence
+// number than the returned one are streamed to the subscriber right after the
+// snapshot.
+type SnapshotHandler func(topic string) (snapshot []*message.Message, seq uint64, err error)
+
+// Config configures an EventBuffer.
+type Config struct {
+	// BufferSize is the maximum number of events retained per topic.
+	// Older events are evicted first once the limit is reached.
+	BufferSize int
+
+	// TTL is how long an event is retained in the buffer before being evicted,
+	// regardless of BufferSize. Zero disables time-based eviction.
+	TTL time.Duration
+
+	// OutputChannelBuffer is the buffer size of channels returned by Subscribe
+	// and SubscribeFromOffset.
+	OutputChannelBuffer int64
+
+	// SendTimeout bounds how long Publish waits for a single subscriber to
+	// consume a message before giving up on it, mirroring
+	// gochannel.GoChannel's sendTimeout. Zero or negative disables the
+	// timeout, so Publish blocks until every subscriber consumes (or the
+	// buffer is closed) - the default.
+	//
+	// Without this, a single subscriber that never drains its channel (e.g.
+	// OutputChannelBuffer: 0 with no reader) stalls Publish - and, since
+	// Publish and SubscribeFromOffset share topicsMu, every other topic's
+	// Publish/Subscribe/SubscribeFromOffset call too - for as long as that
+	// subscriber is stuck.
+	SendTimeout time.Duration
+}
+
+type bufferedEvent struct {
+	seq       uint64
+	msg       *message.Message
+	expiresAt time.Time
+}
+
+// topicBuffer is a linked-list ring buffer of bufferedEvent, oldest first.
+type topicBuffer struct {
+	events  *list.List
+	nextSeq uint64
+}
+
+func newTopicBuffer() *topicBuffer {
+	return &topicBuffer{events: list.New(), nextSeq: 1}
+}
+
+// oldestSeq returns the sequence number of the oldest event still retained,
+// or 0 if the buffer is empty (nothing has been evicted yet).
+func (t *topicBuffer) oldestSeq() uint64 {
+	if front := t.events.Front(); front != nil {
+		return front.Value.(*bufferedEvent).seq
+	}
+	return 0
+}
+
+type subscriber struct {
+	uuid          string
+	outputChannel chan *message.Message
+}
+
+// EventBuffer is a Pub/Sub implementation that, in addition to delivering
+// messages to currently-live subscribers (like gochannel.GoChannel), keeps a
+// bounded per-topic history that SubscribeFromOffset can replay from.
+//
+// EventBuffer has no global state, so the same instance must be used for
+// publishing and subscribing.
+type EventBuffer struct {
+	config Config
+	logger watermill.LoggerAdapter
+
+	topics   map[string]*topicBuffer
+	topicsMu sync.RWMutex
+
+	subscribers   map[string][]*subscriber
+	subscribersMu sync.RWMutex
+
+	snapshotHandlers   map[string]SnapshotHandler
+	snapshotHandlersMu sync.RWMutex
+
+	closed  bool
+	closing chan struct{}
+}
+
+// NewEventBuffer creates a new EventBuffer.
+func NewEventBuffer(config Config, logger watermill.LoggerAdapter) *EventBuffer {
+	if logger == nil {
+		logger = watermill.NopLogger{}
+	}
+
+	return &EventBuffer{
+		config: config,
+		logger: logger,
+
+		topics:      make(map[string]*topicBuffer),
+		subscribers: make(map[string][]*subscriber),
+
+		snapshotHandlers: make(map[string]SnapshotHandler),
+
+		closing: make(chan struct{}),
+	}
+}
+
+// RegisterSnapshotHandler registers a SnapshotHandler used by
+// SubscribeFromOffset to rebuild a base state for topic when the requested
+// offset was already evicted from the buffer.
+func (b *EventBuffer) RegisterSnapshotHandler(topic string, handler SnapshotHandler) {
+	b.snapshotHandlersMu.Lock()
+	defer b.snapshotHandlersMu.Unlock()
+
+	b.snapshotHandlers[topic] = handler
+}
+
+// Publish appends messages to topic's buffer, evicting old events per
+// Config.BufferSize and Config.TTL, and delivers them to every live subscriber.
+//
+// The whole operation runs under topicsMu, so that a concurrent
+// SubscribeFromOffset can't observe a gap between snapshotting the backlog and
+// registering as a live subscriber - it either sees a message in the backlog it
+// read, or is already registered to receive it live, never neither.
+func (b *EventBuffer) Publish(topic string, messages ...*message.Message) error {
+	b.topicsMu.Lock()
+	defer b.topicsMu.Unlock()
+
+	tb, ok := b.topics[topic]
+	if !ok {
+		tb = newTopicBuffer()
+		b.topics[topic] = tb
+	}
+
+	now := time.Now()
+	for _, msg := range messages {
+		seq := tb.nextSeq
+		tb.nextSeq++
+
+		event := &bufferedEvent{seq: seq, msg: msg}
+		if b.config.TTL > 0 {
+			event.expiresAt = now.Add(b.config.TTL)
+		}
+
+		tb.events.PushBack(event)
+	}
+	b.evict(tb, now)
+
+	for _, msg := range messages {
+		if err := b.sendMessage(topic, msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// evict drops events past Config.BufferSize or Config.TTL. topicsMu must be
+// held by the caller.
+func (b *EventBuffer) evict(tb *topicBuffer, now time.Time) {
+	for b.config.BufferSize > 0 && tb.events.Len() > b.config.BufferSize {
+		tb.events.Remove(tb.events.Front())
+	}
+
+	if b.config.TTL <= 0 {
+		return
+	}
+
+	for {
+		front := tb.events.Front()
+		if front == nil {
+			break
+		}
+		if front.Value.(*bufferedEvent).expiresAt.After(now) {
+			break
+		}
+		tb.events.Remove(front)
+	}
+}
+
+func (b *EventBuffer) sendMessage(topic string, msg *message.Message) error {
+	b.subscribersMu.RLock()
+	defer b.subscribersMu.RUnlock()
+
+	for _, s := range b.subscribers[topic] {
+		if err := b.sendMessageToSubscriber(msg, s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *EventBuffer) sendMessageToSubscriber(msg *message.Message, s *subscriber) error {
+	msgToSend := msg.Copy()
+
+	var timeout <-chan time.Time
+	if b.config.SendTimeout > 0 {
+		timeout = time.After(b.config.SendTimeout)
+	}
+
+	select {
+	case s.outputChannel <- msgToSend:
+		b.logger.Trace("Sent buffered event to subscriber", watermill.LogFields{
+			"message_uuid":    msgToSend.UUID,
+			"subscriber_uuid": s.uuid,
+		})
+	case <-timeout:
+		return errors.Errorf("sending message %s to subscriber %s timed out after %s", msgToSend.UUID, s.uuid, b.config.SendTimeout)
+	case <-b.closing:
+	}
+
+	return nil
+}
+
+// Subscribe returns a channel fed with messages published from now on.
+// It does not replay any history - use SubscribeFromOffset to resume from a
+// specific sequence number.
+func (b *EventBuffer) Subscribe(topic string) (chan *message.Message, error) {
+	s := b.newSubscriber()
+
+	// registering under topicsMu keeps this in step with Publish, which holds the
+	// same lock across appending to the buffer and delivering to live subscribers.
+	b.topicsMu.Lock()
+	b.addSubscriber(topic, s)
+	b.topicsMu.Unlock()
+
+	return s.outputChannel, nil
+}
+
+// SubscribeFromOffset returns a channel replaying every retained event of
+// topic with a sequence number greater than seq, followed by live events as
+// they're published.
+//
+// If seq has already been evicted from the buffer, SubscribeFromOffset
+// returns ErrSnapshotRequired unless a SnapshotHandler was registered for
+// topic via RegisterSnapshotHandler, in which case the snapshot it produces
+// is sent first, followed by the live tail - see subscribeFromSnapshot.
+//
+// Otherwise, reading the backlog and registering as a live subscriber happen
+// under the same topicsMu critical section that Publish uses for appending
+// and delivering, so no message can land in the gap between the two and be
+// dropped.
+//
+// The snapshot and the replayed backlog are written to the channel before it
+// is returned. If they don't fit in Config.OutputChannelBuffer, the call
+// fails once Config.SendTimeout elapses, or, without a SendTimeout, blocks
+// until the EventBuffer is closed.
+func (b *EventBuffer) SubscribeFromOffset(topic string, seq uint64) (chan *message.Message, error) {
+	s := b.newSubscriber()
+
+	b.topicsMu.Lock()
+
+	tb, ok := b.topics[topic]
+	if ok {
+		oldest := tb.oldestSeq()
+		if oldest != 0 && seq < oldest-1 {
+			b.topicsMu.Unlock()
+			return b.subscribeFromSnapshot(topic, seq, s)
+		}
+
+		for e := tb.events.Front(); e != nil; e = e.Next() {
+			ev := e.Value.(*bufferedEvent)
+			if ev.seq > seq {
+				if err := b.sendMessageToSubscriber(ev.msg, s); err != nil {
+					b.topicsMu.Unlock()
+					return nil, err
+				}
+			}
+		}
+	}
+
+	b.addSubscriber(topic, s)
+	b.topicsMu.Unlock()
+
+	return s.outputChannel, nil
+}
+
+// subscribeFromSnapshot seeds s with a SnapshotHandler-produced snapshot,
+// followed by the live tail, then registers s as a live subscriber.
+//
+// The handler call itself runs without topicsMu held, so a slow
+// SnapshotHandler (e.g. rebuilding state from a database) doesn't stall
+// Publish/Subscribe/SubscribeFromOffset for every other topic on this
+// EventBuffer for as long as it takes. topicsMu is only reacquired afterwards,
+// to replay anything published while the handler was running (found with a
+// lower seq bound of snapshotSeq rather than seq) and register s as a live
+// subscriber, atomically with each other - the same guarantee
+// SubscribeFromOffset gives callers that don't need a snapshot.
+func (b *EventBuffer) subscribeFromSnapshot(topic string, seq uint64, s *subscriber) (chan *message.Message, error) {
+	b.snapshotHandlersMu.RLock()
+	handler, ok := b.snapshotHandlers[topic]
+	b.snapshotHandlersMu.RUnlock()
+
+	if !ok {
+		return nil, ErrSnapshotRequired{Topic: topic, Offset: seq}
+	}
+
+	snapshot, snapshotSeq, err := handler(topic)
+	if err != nil {
+		return nil, errors.Wrap(err, "snapshot handler failed")
+	}
+
+	for _, msg := range snapshot {
+		if err := b.sendMessageToSubscriber(msg, s); err != nil {
+			return nil, err
+		}
+	}
+
+	b.topicsMu.Lock()
+	defer b.topicsMu.Unlock()
+
+	if tb, ok := b.topics[topic]; ok {
+		for e := tb.events.Front(); e != nil; e = e.Next() {
+			ev := e.Value.(*bufferedEvent)
+			if ev.seq > snapshotSeq {
+				if err := b.sendMessageToSubscriber(ev.msg, s); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	b.addSubscriber(topic, s)
+
+	return s.outputChannel, nil
+}
+
+func (b *EventBuffer) newSubscriber() *subscriber {
+	return &subscriber{
+		uuid:          uuid.NewV4().String(),
+		outputChannel: make(chan *message.Message, b.config.OutputChannelBuffer),
+	}
+}
+
+func (b *EventBuffer) addSubscriber(topic string, s *subscriber) {
+	b.subscribersMu.Lock()
+	defer b.subscribersMu.Unlock()
+
+	b.subscribers[topic] = append(b.subscribers[topic], s)
+}
+
+// Close closes every subscriber channel.
+func (b *EventBuffer) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	close(b.closing)
+
+	b.subscribersMu.Lock()
+	defer b.subscribersMu.Unlock()
+
+	for _, subscribers := range b.subscribers {
+		for _, s := range subscribers {
+			close(s.outputChannel)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,174 @@
+package eventbuffer_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/infrastructure/eventbuffer"
+)
+
+// TestEventBuffer_SubscribeFromOffset_NoGapUnderConcurrentPublish publishes
+// continuously on one goroutine while repeatedly calling SubscribeFromOffset on
+// another, and checks that every subscriber sees every sequence number from
+// where it joined onwards exactly once - i.e. no message published concurrently
+// with a subscribe call is silently dropped.
+func TestEventBuffer_SubscribeFromOffset_NoGapUnderConcurrentPublish(t *testing.T) {
+	const topic = "topic"
+	const messagesCount = 200
+
+	buf := eventbuffer.NewEventBuffer(eventbuffer.Config{
+		BufferSize:          messagesCount,
+		OutputChannelBuffer: int64(messagesCount),
+	}, watermill.NopLogger{})
+	defer buf.Close()
+
+	var publishWg sync.WaitGroup
+	publishWg.Add(1)
+	go func() {
+		defer publishWg.Done()
+		for i := 0; i < messagesCount; i++ {
+			msg := message.NewMessage(watermill.NewUUID(), nil)
+			if err := buf.Publish(topic, msg); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	messages, err := buf.SubscribeFromOffset(topic, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publishWg.Wait()
+
+	seen := make(map[string]bool)
+	timeout := time.After(2 * time.Second)
+	for len(seen) < messagesCount {
+		select {
+		case msg := <-messages:
+			if seen[msg.UUID] {
+				t.Fatalf("message %s delivered more than once", msg.UUID)
+			}
+			seen[msg.UUID] = true
+			msg.Ack()
+		case <-timeout:
+			t.Fatalf("timed out waiting for messages, got %d/%d - some were likely dropped in the subscribe/publish race", len(seen), messagesCount)
+		}
+	}
+}
+
+// TestEventBuffer_Publish_TimesOutOnStuckSubscriber checks that a subscriber
+// which never drains its channel only costs Publish Config.SendTimeout,
+// instead of blocking it (and, since Publish holds topicsMu for its whole
+// duration, every other topic's Publish/Subscribe/SubscribeFromOffset too)
+// forever.
+func TestEventBuffer_Publish_TimesOutOnStuckSubscriber(t *testing.T) {
+	const sendTimeout = 20 * time.Millisecond
+
+	buf := eventbuffer.NewEventBuffer(eventbuffer.Config{
+		OutputChannelBuffer: 0,
+		SendTimeout:         sendTimeout,
+	}, watermill.NopLogger{})
+	defer buf.Close()
+
+	// stuck has no reader and a zero-size buffer, so Publish can never deliver
+	// to it.
+	if _, err := buf.Subscribe("stuck-topic"); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- buf.Publish("stuck-topic", message.NewMessage(watermill.NewUUID(), nil))
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected Publish to time out on a subscriber that never drains its channel")
+		}
+	case <-time.After(sendTimeout * 10):
+		t.Fatal("Publish did not return in time - a stuck subscriber is blocking it (and every other topic) forever")
+	}
+}
+
+// TestEventBuffer_SubscribeFromOffset_ErrSnapshotRequiredWhenEvicted checks
+// that SubscribeFromOffset refuses to silently skip evicted events: once seq
+// has fallen out of the buffer, it returns ErrSnapshotRequired unless a
+// SnapshotHandler is registered for the topic.
+func TestEventBuffer_SubscribeFromOffset_ErrSnapshotRequiredWhenEvicted(t *testing.T) {
+	const topic = "topic"
+
+	buf := eventbuffer.NewEventBuffer(eventbuffer.Config{BufferSize: 2}, watermill.NopLogger{})
+	defer buf.Close()
+
+	for i := 0; i < 5; i++ {
+		if err := buf.Publish(topic, message.NewMessage(watermill.NewUUID(), nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := buf.SubscribeFromOffset(topic, 0)
+	if err == nil {
+		t.Fatal("expected SubscribeFromOffset to refuse an offset evicted from the buffer")
+	}
+	if _, ok := err.(eventbuffer.ErrSnapshotRequired); !ok {
+		t.Fatalf("expected ErrSnapshotRequired, got %T: %v", err, err)
+	}
+}
+
+// TestEventBuffer_SubscribeFromOffset_ReplaysSnapshotWhenEvicted checks that,
+// once a SnapshotHandler is registered, SubscribeFromOffset seeds a subscriber
+// past an evicted offset with the handler's snapshot, followed by the live
+// tail the buffer still retains on top of it.
+func TestEventBuffer_SubscribeFromOffset_ReplaysSnapshotWhenEvicted(t *testing.T) {
+	const topic = "topic"
+
+	// SubscribeFromOffset writes the snapshot and the retained tail (3 messages)
+	// to the channel before returning it, so the channel must be able to hold them.
+	buf := eventbuffer.NewEventBuffer(eventbuffer.Config{BufferSize: 2, OutputChannelBuffer: 3}, watermill.NopLogger{})
+	defer buf.Close()
+
+	for i := 0; i < 5; i++ {
+		if err := buf.Publish(topic, message.NewMessage(watermill.NewUUID(), nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshotMsg := message.NewMessage(watermill.NewUUID(), []byte("snapshot"))
+	buf.RegisterSnapshotHandler(topic, func(topic string) ([]*message.Message, uint64, error) {
+		return []*message.Message{snapshotMsg}, 3, nil
+	})
+
+	messages, err := buf.SubscribeFromOffset(topic, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(2 * time.Second)
+
+	select {
+	case msg := <-messages:
+		if msg.UUID != snapshotMsg.UUID {
+			t.Fatalf("expected the snapshot message first, got %s", msg.UUID)
+		}
+		msg.Ack()
+	case <-timeout:
+		t.Fatal("timed out waiting for the snapshot message")
+	}
+
+	// Events retained past the snapshot's seq (4 and 5, since the snapshot
+	// covers up to seq 3) should follow as the live tail.
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-messages:
+			msg.Ack()
+		case <-timeout:
+			t.Fatalf("timed out waiting for retained event %d/2 after the snapshot", i+1)
+		}
+	}
+}
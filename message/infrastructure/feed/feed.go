@@ -0,0 +1,203 @@
+// Package feed implements a Feed/Subscription primitive, modeled after
+// go-ethereum's event.Feed, adapted to watermill's *message.Message.
+//
+// A Feed multiplexes sends to any number of Subscriptions. Each Subscription
+// exposes a typed error channel and an Unsubscribe method, so callers don't
+// have to hand-roll goroutine bookkeeping to tear subscriptions down.
+package feed
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// Feed implements one-to-many delivery of messages to Subscriptions.
+type Feed struct {
+	sendTimeout time.Duration
+	logger      watermill.LoggerAdapter
+
+	mu          sync.Mutex
+	subscribers map[*Subscription]struct{}
+}
+
+// NewFeed creates a Feed. sendTimeout bounds how long Send waits for a slow
+// subscriber before unsubscribing it; use 0 for no timeout.
+func NewFeed(logger watermill.LoggerAdapter, sendTimeout time.Duration) *Feed {
+	if logger == nil {
+		logger = watermill.NopLogger{}
+	}
+
+	return &Feed{
+		sendTimeout: sendTimeout,
+		logger:      logger,
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe creates a Subscription that receives every message sent on the
+// feed from now on. channelBuffer sets the buffer size of the returned
+// channel.
+func (f *Feed) Subscribe(channelBuffer int64) *Subscription {
+	sub := &Subscription{
+		feed:    f,
+		channel: make(chan *message.Message, channelBuffer),
+		err:     make(chan error, 1),
+	}
+
+	f.mu.Lock()
+	f.subscribers[sub] = struct{}{}
+	f.mu.Unlock()
+
+	return sub
+}
+
+func (f *Feed) remove(sub *Subscription) {
+	f.mu.Lock()
+	delete(f.subscribers, sub)
+	f.mu.Unlock()
+}
+
+// Close unsubscribes every current Subscription, so callers blocked on a
+// Subscription's Err() channel are woken up. It is safe to call more than
+// once, and safe to call concurrently with Send.
+func (f *Feed) Close() {
+	f.mu.Lock()
+	subs := make([]*Subscription, 0, len(f.subscribers))
+	for sub := range f.subscribers {
+		subs = append(subs, sub)
+	}
+	f.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.Unsubscribe()
+	}
+}
+
+// Send delivers msg to every current Subscription, returning how many
+// received it. A copy of msg is sent to each subscriber, consistent with
+// gochannel's behaviour, so acking/nacking by one subscriber doesn't affect
+// others.
+//
+// A subscriber that doesn't consume within sendTimeout is reported a
+// slow-consumer error on its Err() channel and unsubscribed.
+func (f *Feed) Send(msg *message.Message) int {
+	f.mu.Lock()
+	subs := make([]*Subscription, 0, len(f.subscribers))
+	for sub := range f.subscribers {
+		subs = append(subs, sub)
+	}
+	f.mu.Unlock()
+
+	sent := 0
+	for _, sub := range subs {
+		// time.After's channel only ever delivers once, so it must be created fresh
+		// for every subscriber - reusing a single one across the loop would leave
+		// every subscriber after the first timeout (or the first successful send
+		// racing the timer) without timeout protection.
+		var timeout <-chan time.Time
+		if f.sendTimeout > 0 {
+			timeout = time.After(f.sendTimeout)
+		}
+
+		select {
+		case sub.channel <- msg.Copy():
+			sent++
+		case <-timeout:
+			sub.reportErr(errors.Errorf("feed: slow consumer, unsubscribing"))
+			sub.Unsubscribe()
+		}
+	}
+
+	return sent
+}
+
+// Subscription represents a subscription to a Feed.
+type Subscription struct {
+	feed    *Feed
+	channel chan *message.Message
+
+	errOnce sync.Once
+	err     chan error
+}
+
+// C returns the channel messages are delivered on.
+func (s *Subscription) C() <-chan *message.Message {
+	return s.channel
+}
+
+// Err returns a channel that receives a single value when the subscription
+// is terminated for a reason other than Unsubscribe being called (e.g. a
+// slow-consumer timeout), and is closed when Unsubscribe is called.
+func (s *Subscription) Err() <-chan error {
+	return s.err
+}
+
+// Unsubscribe removes the subscription from its Feed and closes its Err()
+// channel. The channel returned by C is not closed. It is safe to call more
+// than once.
+func (s *Subscription) Unsubscribe() {
+	s.feed.remove(s)
+	s.errOnce.Do(func() {
+		close(s.err)
+	})
+}
+
+func (s *Subscription) reportErr(err error) {
+	s.errOnce.Do(func() {
+		s.err <- err
+		close(s.err)
+	})
+}
+
+// SubscriptionScope tracks a bundle of Subscriptions and cancels all of them
+// on Close, so a caller that accumulates several - e.g. subscribing to more
+// than one gochannel.GoChannel.Feed() topic - can tear them all down in one
+// call instead of tracking each one individually.
+type SubscriptionScope struct {
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+// Track adds sub to the scope and returns it unchanged, so it can be used
+// inline: sub := scope.Track(feed.Subscribe(1)).
+//
+// If the scope is already closed, sub is unsubscribed immediately.
+func (sc *SubscriptionScope) Track(sub *Subscription) *Subscription {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.closed {
+		sub.Unsubscribe()
+		return sub
+	}
+
+	if sc.subs == nil {
+		sc.subs = make(map[*Subscription]struct{})
+	}
+	sc.subs[sub] = struct{}{}
+
+	return sub
+}
+
+// Close unsubscribes every Subscription tracked by the scope. It is safe to
+// call more than once.
+func (sc *SubscriptionScope) Close() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.closed {
+		return
+	}
+	sc.closed = true
+
+	for sub := range sc.subs {
+		sub.Unsubscribe()
+	}
+	sc.subs = nil
+}
@@ -0,0 +1,79 @@
+package feed_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/infrastructure/feed"
+)
+
+// TestFeed_Send_EachSubscriberGetsItsOwnTimeout ensures a slow subscriber only
+// costs Send its own sendTimeout, rather than consuming the only timeout window
+// and leaving every subscriber after it in the iteration order unprotected.
+func TestFeed_Send_EachSubscriberGetsItsOwnTimeout(t *testing.T) {
+	const sendTimeout = 20 * time.Millisecond
+
+	f := feed.NewFeed(watermill.NopLogger{}, sendTimeout)
+
+	// slow has no reader and a zero-size buffer, so Send can never deliver to it.
+	slow := f.Subscribe(0)
+	defer slow.Unsubscribe()
+
+	// fast has a buffered channel, so Send should still be able to deliver to it
+	// even after timing out on slow.
+	fast := f.Subscribe(1)
+	defer fast.Unsubscribe()
+
+	done := make(chan int, 1)
+	go func() {
+		done <- f.Send(message.NewMessage(watermill.NewUUID(), nil))
+	}()
+
+	select {
+	case sent := <-done:
+		if sent != 1 {
+			t.Fatalf("expected Send to deliver to the fast subscriber despite the slow one timing out, got sent=%d", sent)
+		}
+	case <-time.After(sendTimeout * 4):
+		t.Fatal("Send did not return in time - a stale timeout channel is blocking delivery to later subscribers")
+	}
+
+	select {
+	case <-fast.C():
+	default:
+		t.Fatal("fast subscriber never received the message")
+	}
+}
+
+// TestSubscriptionScope_Close_UnsubscribesEveryTrackedSubscription checks that
+// a single Close call tears down every Subscription tracked by a
+// SubscriptionScope, and that a scope closed before a Subscription is tracked
+// unsubscribes it immediately instead of silently keeping it alive.
+func TestSubscriptionScope_Close_UnsubscribesEveryTrackedSubscription(t *testing.T) {
+	f := feed.NewFeed(watermill.NopLogger{}, 0)
+
+	var scope feed.SubscriptionScope
+	a := scope.Track(f.Subscribe(1))
+	b := scope.Track(f.Subscribe(1))
+
+	scope.Close()
+
+	for _, sub := range []*feed.Subscription{a, b} {
+		select {
+		case <-sub.Err():
+		default:
+			t.Fatal("expected Close to unsubscribe every tracked Subscription")
+		}
+	}
+
+	// Track after Close should unsubscribe the new Subscription right away,
+	// rather than leaking it past the scope's lifetime.
+	c := scope.Track(f.Subscribe(1))
+	select {
+	case <-c.Err():
+	default:
+		t.Fatal("expected Track to unsubscribe immediately once the scope is closed")
+	}
+}
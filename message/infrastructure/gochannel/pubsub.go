@@ -11,12 +11,14 @@ import (
 
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/infrastructure/feed"
 )
 
 const noTimeout time.Duration = -1
 
 type subscriber struct {
 	uuid          string
+	group         string
 	outputChannel chan *message.Message
 }
 
@@ -29,9 +31,20 @@ type GoChannel struct {
 	sendTimeout         time.Duration
 	outputChannelBuffer int64
 
-	subscribers     map[string][]*subscriber
+	// subscribers holds, per topic, the subscribers grouped by their consumer group.
+	// Subscribers without an explicit group are assigned a group equal to their own
+	// uuid, so that every one of them keeps receiving every message, preserving
+	// today's fan-out semantics.
+	subscribers     map[string]map[string][]*subscriber
 	subscribersLock *sync.RWMutex
 
+	// nextSubscriberInGroup tracks, per topic and group, the index of the next
+	// subscriber that should receive a message, so that delivery within a group
+	// is round-robin. It's mutated from sendMessage, which only holds
+	// subscribersLock for reading, so it needs its own lock.
+	nextSubscriberInGroup     map[string]map[string]int
+	nextSubscriberInGroupLock sync.Mutex
+
 	logger watermill.LoggerAdapter
 
 	closed  bool
@@ -40,6 +53,19 @@ type GoChannel struct {
 	persistent    bool
 	messages      map[string][]*message.Message
 	messagesMutex sync.RWMutex
+
+	// groupOffsets records, per topic and group, the index in messages[topic]
+	// from which a newly created group should start reading. It is only set
+	// the first time a group is seen, so late joiners into an already existing
+	// group don't replay messages the group already made progress on. It's
+	// mutated from addSubscriber, which only holds messagesMutex for reading,
+	// so it needs its own lock.
+	groupOffsets     map[string]map[string]int
+	groupOffsetsLock sync.Mutex
+
+	// feeds holds, per topic, the feed.Feed view created on first call to Feed.
+	feeds     map[string]*feed.Feed
+	feedsLock sync.RWMutex
 }
 
 func (g *GoChannel) Publisher() message.Publisher {
@@ -50,32 +76,39 @@ func (g *GoChannel) Subscriber() message.Subscriber {
 	return g
 }
 
-func NewGoChannel(outputChannelBuffer int64, logger watermill.LoggerAdapter, sendTimeout time.Duration) message.PubSub {
+func NewGoChannel(outputChannelBuffer int64, logger watermill.LoggerAdapter, sendTimeout time.Duration) *GoChannel {
 	return &GoChannel{
 		sendTimeout:         sendTimeout,
 		outputChannelBuffer: outputChannelBuffer,
 
-		subscribers:     make(map[string][]*subscriber),
-		subscribersLock: &sync.RWMutex{},
-		logger:          logger,
+		subscribers:           make(map[string]map[string][]*subscriber),
+		subscribersLock:       &sync.RWMutex{},
+		nextSubscriberInGroup: make(map[string]map[string]int),
+		logger:                logger,
 
 		closing: make(chan struct{}),
+
+		feeds: make(map[string]*feed.Feed),
 	}
 }
 
-func NewPersistentGoChannel(outputChannelBuffer int64, logger watermill.LoggerAdapter, sendTimeout time.Duration) message.PubSub {
+func NewPersistentGoChannel(outputChannelBuffer int64, logger watermill.LoggerAdapter, sendTimeout time.Duration) *GoChannel {
 	return &GoChannel{
 		sendTimeout:         sendTimeout,
 		outputChannelBuffer: outputChannelBuffer,
 
-		subscribers:     make(map[string][]*subscriber),
-		subscribersLock: &sync.RWMutex{},
-		logger:          logger,
+		subscribers:           make(map[string]map[string][]*subscriber),
+		subscribersLock:       &sync.RWMutex{},
+		nextSubscriberInGroup: make(map[string]map[string]int),
+		logger:                logger,
 
 		closing: make(chan struct{}),
 
-		persistent: true,
-		messages:   map[string][]*message.Message{},
+		persistent:   true,
+		messages:     map[string][]*message.Message{},
+		groupOffsets: map[string]map[string]int{},
+
+		feeds: make(map[string]*feed.Feed),
 	}
 }
 
@@ -104,15 +137,27 @@ func (g *GoChannel) Publish(topic string, messages ...*message.Message) error {
 }
 
 func (g *GoChannel) sendMessage(topic string, message *message.Message) error {
+	g.feedsLock.RLock()
+	f, hasFeed := g.feeds[topic]
+	g.feedsLock.RUnlock()
+	if hasFeed {
+		f.Send(message)
+	}
+
 	g.subscribersLock.RLock()
 	defer g.subscribersLock.RUnlock()
 
-	subscribers, ok := g.subscribers[topic]
+	groups, ok := g.subscribers[topic]
 	if !ok {
 		return nil
 	}
 
-	for _, s := range subscribers {
+	for group, subscribers := range groups {
+		if len(subscribers) == 0 {
+			continue
+		}
+
+		s := g.pickSubscriberFromGroup(topic, group, subscribers)
 		if err := g.sendMessageToSubscriber(message, s, g.sendTimeout); err != nil {
 			return err
 		}
@@ -121,10 +166,47 @@ func (g *GoChannel) sendMessage(topic string, message *message.Message) error {
 	return nil
 }
 
+// Feed returns a *feed.Feed view of topic, so callers can rely on
+// feed.Subscription's lifecycle management (Err channel, Unsubscribe,
+// SubscriptionScope) instead of a plain channel.
+//
+// Messages published to topic are delivered to the feed alongside regular
+// subscribers obtained via Subscribe/SubscribeWithGroup, so existing code
+// keeps working unchanged.
+func (g *GoChannel) Feed(topic string) *feed.Feed {
+	g.feedsLock.Lock()
+	defer g.feedsLock.Unlock()
+
+	f, ok := g.feeds[topic]
+	if !ok {
+		f = feed.NewFeed(g.logger, g.sendTimeout)
+		g.feeds[topic] = f
+	}
+
+	return f
+}
+
+// pickSubscriberFromGroup returns the next subscriber that should receive a message
+// within the given group, rotating round-robin across the group's members.
+func (g *GoChannel) pickSubscriberFromGroup(topic, group string, subscribers []*subscriber) *subscriber {
+	g.nextSubscriberInGroupLock.Lock()
+	defer g.nextSubscriberInGroupLock.Unlock()
+
+	if _, ok := g.nextSubscriberInGroup[topic]; !ok {
+		g.nextSubscriberInGroup[topic] = make(map[string]int)
+	}
+
+	idx := g.nextSubscriberInGroup[topic][group] % len(subscribers)
+	g.nextSubscriberInGroup[topic][group] = idx + 1
+
+	return subscribers[idx]
+}
+
 func (g *GoChannel) sendMessageToSubscriber(msg *message.Message, s *subscriber, sendTimeout time.Duration) error {
 	subscriberLogFields := watermill.LogFields{
 		"message_uuid":    msg.UUID,
 		"subscriber_uuid": s.uuid,
+		"consumer_group":  s.group,
 	}
 
 SendToSubscriber:
@@ -175,18 +257,54 @@ SendToSubscriber:
 // Messages are not persisted. If there are no subscribers and message is produced it will be gone.
 //
 // There are no consumer groups support etc. Every consumer will receive every produced message.
+//
+// Use SubscribeWithGroup if you need competing-consumer semantics.
 func (g *GoChannel) Subscribe(topic string) (chan *message.Message, error) {
 	s := &subscriber{
 		uuid:          uuid.NewV4().String(),
 		outputChannel: make(chan *message.Message, g.outputChannelBuffer),
 	}
+	// an ungrouped subscriber is put alone in a group named after its own uuid,
+	// so it keeps receiving every message published to the topic.
+	s.group = s.uuid
+
+	g.addSubscriber(topic, s, true)
+
+	return s.outputChannel, nil
+}
+
+// SubscribeWithGroup works like Subscribe, but messages published to topic are delivered
+// to exactly one subscriber within group, picked round-robin, while other groups
+// subscribed to the same topic each receive their own copy.
+//
+// In persistent mode, a group's first subscriber only receives messages produced after
+// the group was created - earlier messages are not replayed to it. Subsequent subscribers
+// joining an already existing group don't receive any backlog either, since the group is
+// already making progress.
+func (g *GoChannel) SubscribeWithGroup(topic, group string) (chan *message.Message, error) {
+	s := &subscriber{
+		uuid:          uuid.NewV4().String(),
+		group:         group,
+		outputChannel: make(chan *message.Message, g.outputChannelBuffer),
+	}
+
+	g.addSubscriber(topic, s, false)
+
+	return s.outputChannel, nil
+}
 
+func (g *GoChannel) addSubscriber(topic string, s *subscriber, replayBacklog bool) {
 	go func(s *subscriber) {
 		g.messagesMutex.RLock()
 
 		if g.persistent {
+			from := 0
+			if !replayBacklog {
+				from = g.groupStartOffset(topic, s.group)
+			}
+
 			if messages, ok := g.messages[topic]; ok {
-				for _, msg := range messages {
+				for _, msg := range messages[from:] {
 					if err := g.sendMessageToSubscriber(msg, s, noTimeout); err != nil {
 						panic(err)
 					}
@@ -201,13 +319,37 @@ func (g *GoChannel) Subscribe(topic string) (chan *message.Message, error) {
 		g.messagesMutex.RUnlock()
 
 		if _, ok := g.subscribers[topic]; !ok {
-			g.subscribers[topic] = make([]*subscriber, 0)
+			g.subscribers[topic] = make(map[string][]*subscriber)
 		}
-		g.subscribers[topic] = append(g.subscribers[topic], s)
-
+		g.subscribers[topic][s.group] = append(g.subscribers[topic][s.group], s)
 	}(s)
+}
 
-	return s.outputChannel, nil
+// groupStartOffset returns the index in g.messages[topic] from which a newly joining
+// subscriber of group should start reading. The very first subscriber of a group
+// establishes the group's offset at the current topic length, so it only sees
+// messages produced from that point on. Subscribers joining an already existing
+// group don't replay anything - the group's live members already cover everything
+// published since the group was created. messagesMutex must be held (for reading
+// at least) by the caller, to keep len(g.messages[topic]) consistent with concurrent
+// Publish calls.
+func (g *GoChannel) groupStartOffset(topic, group string) int {
+	g.groupOffsetsLock.Lock()
+	defer g.groupOffsetsLock.Unlock()
+
+	if _, ok := g.groupOffsets[topic]; !ok {
+		g.groupOffsets[topic] = make(map[string]int)
+	}
+
+	if _, ok := g.groupOffsets[topic][group]; ok {
+		// group already exists - nothing to replay, just start from the current tail
+		return len(g.messages[topic])
+	}
+
+	offset := len(g.messages[topic])
+	g.groupOffsets[topic][group] = offset
+
+	return offset
 }
 
 func (g *GoChannel) Close() error {
@@ -217,12 +359,20 @@ func (g *GoChannel) Close() error {
 	g.closed = true
 	close(g.closing)
 
+	g.feedsLock.RLock()
+	for _, f := range g.feeds {
+		f.Close()
+	}
+	g.feedsLock.RUnlock()
+
 	g.subscribersLock.Lock()
 	defer g.subscribersLock.Unlock()
 
-	for _, topicSubscribers := range g.subscribers {
-		for _, subscriber := range topicSubscribers {
-			close(subscriber.outputChannel)
+	for _, topicGroups := range g.subscribers {
+		for _, groupSubscribers := range topicGroups {
+			for _, subscriber := range groupSubscribers {
+				close(subscriber.outputChannel)
+			}
 		}
 	}
 
@@ -0,0 +1,164 @@
+package gochannel_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/infrastructure/gochannel"
+)
+
+// TestGoChannel_SubscribeWithGroup_RoundRobin checks that messages published to a
+// topic are spread round-robin across the subscribers of a single consumer group.
+func TestGoChannel_SubscribeWithGroup_RoundRobin(t *testing.T) {
+	pubSub := gochannel.NewGoChannel(0, watermill.NopLogger{}, -1)
+	defer pubSub.Close()
+
+	const topic = "topic"
+	const group = "group"
+	const subscribersCount = 2
+	const messagesCount = 10
+
+	received := make([]int, subscribersCount)
+	var receivedLock sync.Mutex
+	var wg sync.WaitGroup
+
+	for i := 0; i < subscribersCount; i++ {
+		messages, err := pubSub.SubscribeWithGroup(topic, group)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for msg := range messages {
+				receivedLock.Lock()
+				received[i]++
+				receivedLock.Unlock()
+				msg.Ack()
+			}
+		}(i)
+	}
+
+	allReceived := func() bool {
+		receivedLock.Lock()
+		defer receivedLock.Unlock()
+		for _, count := range received {
+			if count == 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	// SubscribeWithGroup registers its subscriber asynchronously (see
+	// addSubscriber), so publishing right after subscribing can race ahead of
+	// registration and be silently dropped - with neither subscriber
+	// registered yet, a burst of messagesCount publishes can vanish entirely
+	// instead of reaching either one. Keep publishing until every subscriber
+	// in the group has received at least one message instead of a fixed
+	// count, so the test only depends on registration eventually completing.
+	deadline := time.After(2 * time.Second)
+	for !allReceived() {
+		select {
+		case <-deadline:
+			t.Fatal("timed out waiting for every subscriber in the group to receive at least one message")
+		default:
+		}
+
+		msg := message.NewMessage(watermill.NewUUID(), nil)
+		if err := pubSub.Publish(topic, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pubSub.Close()
+	wg.Wait()
+
+	for i, count := range received {
+		if count == 0 {
+			t.Errorf("subscriber %d in group %q received no messages, expected round-robin delivery", i, group)
+		}
+	}
+}
+
+// TestGoChannel_ConcurrentPublishToGroups exercises pickSubscriberFromGroup and
+// groupStartOffset under concurrent Publish/SubscribeWithGroup calls. It's meant to
+// be run with -race: both maps are mutated while the caller only holds a read lock,
+// so concurrent access must be protected by their own locks.
+func TestGoChannel_ConcurrentPublishToGroups(t *testing.T) {
+	pubSub := gochannel.NewPersistentGoChannel(0, watermill.NopLogger{}, -1)
+	defer pubSub.Close()
+
+	const topic = "topic"
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msg := message.NewMessage(watermill.NewUUID(), nil)
+			_ = pubSub.Publish(topic, msg)
+		}(i)
+	}
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			messages, err := pubSub.SubscribeWithGroup(topic, "shared-group")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			go func() {
+				for msg := range messages {
+					msg.Ack()
+				}
+			}()
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+// TestGoChannel_Close_ClosesFeedSubscriptions checks that Close tears down every
+// Feed subscription created via GoChannel.Feed, so a consumer selecting on
+// Subscription.Err() actually gets woken up instead of being left to block
+// forever past Close.
+func TestGoChannel_Close_ClosesFeedSubscriptions(t *testing.T) {
+	pubSub := gochannel.NewGoChannel(0, watermill.NopLogger{}, -1)
+
+	const topic = "topic"
+
+	sub := pubSub.Feed(topic).Subscribe(1)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-sub.C():
+			case _, ok := <-sub.Err():
+				if ok {
+					t.Error("unexpected value on Err()")
+				}
+				return
+			}
+		}
+	}()
+
+	if err := pubSub.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Feed subscription was not terminated by GoChannel.Close")
+	}
+}